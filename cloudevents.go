@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// messageFormat selects how an incoming pubsub.Message payload is interpreted
+type messageFormat string
+
+const (
+	// formatRaw passes msg.Data through unmodified (default)
+	formatRaw messageFormat = "raw"
+	// formatCloudEvents parses msg as a CloudEvents 1.0 structured or binary-mode message
+	formatCloudEvents messageFormat = "cloudevents"
+)
+
+// cloudEventContentType is the content-type used by CloudEvents structured mode
+const cloudEventContentType = "application/cloudevents+json"
+
+// cloudEvent holds the CloudEvents 1.0 context attributes gpubsub exposes
+type cloudEvent struct {
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            string
+	DataContentType string
+}
+
+// fields returns the CE context as a plain map, used both for GSUB_CE_* replaces
+// and for `cefield:` if-matching
+func (ce *cloudEvent) fields() map[string]string {
+	return map[string]string{
+		"id":              ce.ID,
+		"source":          ce.Source,
+		"type":            ce.Type,
+		"subject":         ce.Subject,
+		"time":            ce.Time,
+		"datacontenttype": ce.DataContentType,
+	}
+}
+
+// structuredCloudEvent mirrors the JSON shape used by CloudEvents structured mode
+type structuredCloudEvent struct {
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      string          `json:"data_base64"`
+}
+
+// parseCloudEvent extracts the CloudEvents context and raw payload from msg, trying
+// structured mode (application/cloudevents+json content type) first, then falling
+// back to binary mode (the `ce-*` attribute prefix convention)
+func parseCloudEvent(msg *pubsub.Message) (*cloudEvent, []byte, error) {
+	if ct, ok := contentTypeAttr(msg.Attributes); ok && strings.HasPrefix(ct, cloudEventContentType) {
+		var sce structuredCloudEvent
+		if err := json.Unmarshal(msg.Data, &sce); err != nil {
+			return nil, nil, err
+		}
+		data := []byte(sce.Data)
+		if sce.DataBase64 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(sce.DataBase64)
+			if err != nil {
+				return nil, nil, err
+			}
+			data = decoded
+		}
+		return &cloudEvent{
+			ID:              sce.ID,
+			Source:          sce.Source,
+			Type:            sce.Type,
+			Subject:         sce.Subject,
+			Time:            sce.Time,
+			DataContentType: sce.DataContentType,
+		}, data, nil
+	}
+
+	ce := &cloudEvent{
+		ID:              msg.Attributes["ce-id"],
+		Source:          msg.Attributes["ce-source"],
+		Type:            msg.Attributes["ce-type"],
+		Subject:         msg.Attributes["ce-subject"],
+		Time:            msg.Attributes["ce-time"],
+		DataContentType: msg.Attributes["ce-datacontenttype"],
+	}
+	return ce, msg.Data, nil
+}
+
+// contentTypeAttr looks up the content-type attribute regardless of casing
+func contentTypeAttr(attrs map[string]string) (string, bool) {
+	for k, v := range attrs {
+		if strings.EqualFold(k, "content-type") {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+var (
+	execSemaphoreMu sync.Mutex
+	// execSemaphore bounds the total number of concurrently running exec.Command
+	// invocations across all subscriptions, so a burst of messages can't fork-bomb the host
+	execSemaphore chan struct{}
+	// execSemaphoreMax is the limit execSemaphore was last sized for, so a reload that
+	// re-parses the same max_concurrent_exec doesn't replace the channel out from under
+	// exec calls that acquired a slot on it before the reload and release it after
+	execSemaphoreMax int
+)
+
+// initExecSemaphore sizes the module-wide exec concurrency limit; max <= 0 means
+// unlimited. A no-op if max is unchanged from the last call, so a config reload that
+// leaves max_concurrent_exec alone doesn't swap the channel under in-flight
+// acquire/release pairs and corrupt the concurrency accounting
+func initExecSemaphore(max int) {
+	execSemaphoreMu.Lock()
+	defer execSemaphoreMu.Unlock()
+	if max == execSemaphoreMax {
+		return
+	}
+	if max <= 0 {
+		execSemaphore = nil
+	} else {
+		execSemaphore = make(chan struct{}, max)
+	}
+	execSemaphoreMax = max
+}
+
+// acquireExecSlot blocks until a module-wide exec slot is free, if a limit is set
+func acquireExecSlot() {
+	execSemaphoreMu.Lock()
+	sem := execSemaphore
+	execSemaphoreMu.Unlock()
+	if sem != nil {
+		sem <- struct{}{}
+	}
+}
+
+// releaseExecSlot frees a module-wide exec slot acquired via acquireExecSlot
+func releaseExecSlot() {
+	execSemaphoreMu.Lock()
+	sem := execSemaphore
+	execSemaphoreMu.Unlock()
+	if sem != nil {
+		<-sem
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -16,6 +18,13 @@ import (
 type subsConfig struct {
 	// ProjectID is Google Cloud project ID
 	ProjectID string `yaml:"project"`
+	// MaxConcurrentExec caps the total number of concurrent exec.Command invocations
+	// across all subscriptions, guarding against a burst of messages fork-bombing the
+	// host. 0 (default) means unlimited
+	MaxConcurrentExec int `yaml:"max_concurrent_exec"`
+	// MetricsAddr, if set, serves a Prometheus /metrics endpoint (e.g. "localhost:9090")
+	// exposing the current in-flight message count. Disabled by default
+	MetricsAddr string `yaml:"metrics_addr"`
 	// Subscriptions are subscriptions settings
 	Subscriptions []struct {
 		// Name is a name of subscription as given in Google Cloud console
@@ -31,6 +40,39 @@ type subsConfig struct {
 		// `none` - nothing will be passed.
 		// Default is `var`
 		DataVia string `yaml:"data"`
+		// Format selects how msg.Data/msg.Attributes are interpreted: `raw` (default)
+		// passes them through unmodified, `cloudevents` parses a CloudEvents 1.0
+		// structured or binary-mode message, exposing its context as GSUB_CE_*
+		// replacement variables and stripping the envelope before Command/sinks see data
+		Format string `yaml:"format"`
+		// Sink selects where matched messages are dispatched: `exec` (default) runs
+		// Command via os/exec, `http` POSTs the message to a URL (see HTTP), `worker`
+		// feeds a persistent long-running child process over stdin (see Worker)
+		Sink string `yaml:"sink"`
+		// HTTP holds sink-specific settings when Sink is `http`
+		HTTP *httpSinkYaml `yaml:"http"`
+		// Worker holds sink-specific settings when Sink is `worker`
+		Worker *workerSinkYaml `yaml:"worker"`
+		// MaxConcurrent sets ReceiveSettings.NumGoroutines, the number of goroutines
+		// used to pull and process this subscription's messages in parallel. 0 (default)
+		// leaves the Pub/Sub client's own default in place
+		MaxConcurrent int `yaml:"max_concurrent"`
+		// MaxOutstanding sets ReceiveSettings.MaxOutstandingMessages, the number of
+		// unacked messages the client buffers before pausing delivery. 0 (default)
+		// leaves the Pub/Sub client's own default in place
+		MaxOutstanding int `yaml:"max_outstanding"`
+		// MaxOutstandingBytes sets ReceiveSettings.MaxOutstandingBytes accordingly
+		MaxOutstandingBytes int `yaml:"max_outstanding_bytes"`
+		// Synchronous forces this subscription's messages to be processed one at a
+		// time, in delivery order, instead of concurrently
+		Synchronous bool `yaml:"synchronous"`
+		// Retry configures local jittered backoff and a delivery attempt cap for
+		// messages whose command/sink keeps failing. Absent means nack indefinitely,
+		// the previous behavior
+		Retry *retryYaml `yaml:"retry"`
+		// DeadLetter is where a message goes once Retry.MaxAttempts is exhausted,
+		// after which it is Acked to stop redelivery. Requires Retry.MaxAttempts
+		DeadLetter *deadLetterYaml `yaml:"dead_letter"`
 		// Ifs is an array of filters and commands
 		Ifs []*ifConfig `yaml:"if"`
 		// Test is a test data
@@ -38,19 +80,110 @@ type subsConfig struct {
 	} `yaml:"subs"`
 }
 
+// httpSinkYaml configures the `http` sink
+type httpSinkYaml struct {
+	// URL is where the message is POSTed; GSUB_* variables are replaced
+	URL string `yaml:"url"`
+	// Headers are extra HTTP headers to send; GSUB_* variables are replaced in values
+	Headers map[string]string `yaml:"headers"`
+	// Encoding selects how message data fills the request body:
+	// `raw` - unmodified bytes (default), `base64` - base64-encoded string,
+	// `json` - {id, attributes, data} wrapper with base64-encoded data
+	Encoding string `yaml:"encoding"`
+}
+
+// workerSinkYaml configures the `worker` sink
+type workerSinkYaml struct {
+	// Command is the worker process with args, kept running and fed messages over
+	// stdin, each one framed with a 4-byte big-endian length prefix
+	Command []string `yaml:"cmd"`
+}
+
+// retryYaml configures the `retry` block
+type retryYaml struct {
+	// MaxAttempts is the delivery attempt at which gpubsub stops nacking and sends the
+	// message to DeadLetter instead. 0 (default) nacks indefinitely
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff is a duration string (e.g. "1s") slept before the second delivery
+	// attempt. Empty means no backoff
+	InitialBackoff string `yaml:"initial_backoff"`
+	// MaxBackoff is a duration string capping the computed backoff regardless of
+	// attempt count. Empty means uncapped
+	MaxBackoff string `yaml:"max_backoff"`
+	// Multiplier scales InitialBackoff by itself for every attempt beyond the second.
+	// <= 0 behaves as 1 (constant backoff)
+	Multiplier float64 `yaml:"multiplier"`
+	// Jitter randomizes the computed backoff by +/- this fraction (0..1)
+	Jitter float64 `yaml:"jitter"`
+}
+
+// deadLetterYaml configures the `dead_letter` block
+type deadLetterYaml struct {
+	// Topic republishes the message to another Pub/Sub topic with diagnostic
+	// attributes (original sub, last exit code, stderr tail)
+	Topic string `yaml:"topic"`
+	// File appends a JSONL record per dead-lettered message to a rotating file
+	File string `yaml:"file"`
+}
+
 type ifConfig struct {
+	// --- value sources; exactly one may be set on a leaf condition ---
+
 	// MetaKey specifies message's metadata key that should be evaluated
 	MetaKey string `yaml:"metakey"`
-	// Equal contains RE2 pattern that will be matched against input value (metadata value, for instance)
+	// CEField specifies a CloudEvents context field to evaluate (requires `format: cloudevents`):
+	// `id`, `source`, `type`, `subject`, `time` or `datacontenttype`
+	CEField string `yaml:"cefield"`
+	// JSONPath specifies a dotted path (e.g. `$.event.kind`, `$.items[0].id`) evaluated
+	// against msg.Data once it's parsed as JSON
+	JSONPath string `yaml:"jsonpath"`
+	// BodyRegex is an RE2 pattern matched against the raw msg.Data directly; it is
+	// both the source and the condition, so Equal/NotEqual/Gt/Lt/Before/After are unused
+	BodyRegex string `yaml:"bodyregex"`
+	// AttrExists is a message metadata key whose mere presence (any value) satisfies
+	// the condition; Equal/NotEqual/Gt/Lt/Before/After are unused
+	AttrExists string `yaml:"attr_exists"`
+	// DeliveryAttempt, if true, evaluates this subscription's locally tracked delivery
+	// attempt count (1 on first delivery) instead of a message field
+	DeliveryAttempt bool `yaml:"delivery_attempt"`
+
+	// --- operators; exactly one applies to the resolved source value, except ---
+	// --- BodyRegex/AttrExists above, which are self-contained ---
+
+	// Equal is an RE2 pattern the value must match
 	Equal string `yaml:"equal"`
-	// Command is a command with args to perfrom
+	// NotEqual is an RE2 pattern the value must not match
+	NotEqual string `yaml:"not_equal"`
+	// GT requires the value, parsed as a float, to be greater than this number
+	GT string `yaml:"gt"`
+	// LT requires the value, parsed as a float, to be less than this number
+	LT string `yaml:"lt"`
+	// Before requires the value, parsed as RFC3339, to be before this RFC3339 instant.
+	// With no source set, the value defaults to msg.PublishTime
+	Before string `yaml:"before"`
+	// After is Before's opposite
+	After string `yaml:"after"`
+
+	// --- boolean combinators; compose nested conditions instead of a leaf test ---
+
+	// All requires every nested condition to match (logical AND)
+	All []*ifConfig `yaml:"all"`
+	// Any requires at least one nested condition to match (logical OR)
+	Any []*ifConfig `yaml:"any"`
+	// Not negates a single nested condition
+	Not *ifConfig `yaml:"not"`
+
+	// Command is a command with args to perfrom. Only meaningful on a top-level if/then
+	// entry, not on a condition nested under All/Any/Not
 	Command []string `yaml:"cmd"`
-	// Then contains nested ifs
+	// Then contains nested ifs. Only meaningful on a top-level if/then entry, not on a
+	// condition nested under All/Any/Not
 	Then []*ifConfig `yaml:"then"`
 }
 
-// parseSubsConfig reads subs.yaml content
-func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTests bool, err error) {
+// parseSubsConfig reads subs.yaml content. configHash fingerprints the whole file, so
+// operators can confirm from the logs that a reload picked up the change they expected
+func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTests bool, metricsAddr string, configHash string, err error) {
 	project = ""
 	subz = make(map[string]*subData)
 	hasTests = false
@@ -62,7 +195,12 @@ func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTes
 		return
 	}
 
+	sum := sha256.Sum256(b)
+	configHash = hex.EncodeToString(sum[:])
+
 	project = cfg.ProjectID
+	metricsAddr = cfg.MetricsAddr
+
 	for _, v := range cfg.Subscriptions {
 		// skip
 		if v.Disable {
@@ -95,6 +233,76 @@ func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTes
 			return
 		}
 
+		// message format
+		var msgFormat = formatRaw
+		switch v.Format {
+		case "", "raw":
+			msgFormat = formatRaw
+		case "cloudevents":
+			msgFormat = formatCloudEvents
+		default:
+			err = errors.New("invalid format: " + v.Format)
+			return
+		}
+
+		// sink
+		var snk *sink
+		switch v.Sink {
+		case "", "exec":
+			snk = &sink{Type: sinkExec}
+		case "http":
+			if v.HTTP == nil || v.HTTP.URL == "" {
+				err = errors.New("http sink requires url: " + v.Name)
+				return
+			}
+			snk = newHTTPSink(v.HTTP)
+		case "worker":
+			if v.Worker == nil || len(v.Worker.Command) == 0 || strings.TrimSpace(v.Worker.Command[0]) == "" {
+				err = errors.New("worker sink requires cmd: " + v.Name)
+				return
+			}
+			snk = newWorkerSink(v.Worker)
+		default:
+			err = errors.New("invalid sink: " + v.Sink)
+			return
+		}
+
+		// retry policy
+		var retry *retryPolicy
+		if v.Retry != nil {
+			retry = &retryPolicy{
+				MaxAttempts: v.Retry.MaxAttempts,
+				Multiplier:  v.Retry.Multiplier,
+				Jitter:      v.Retry.Jitter,
+			}
+			if v.Retry.InitialBackoff != "" {
+				d, perr := time.ParseDuration(v.Retry.InitialBackoff)
+				if perr != nil {
+					err = errors.New("invalid retry initial_backoff: " + perr.Error())
+					return
+				}
+				retry.InitialBackoff = d
+			}
+			if v.Retry.MaxBackoff != "" {
+				d, perr := time.ParseDuration(v.Retry.MaxBackoff)
+				if perr != nil {
+					err = errors.New("invalid retry max_backoff: " + perr.Error())
+					return
+				}
+				retry.MaxBackoff = d
+			}
+		}
+
+		// dead letter
+		var deadLetter *deadLetterConfig
+		if v.DeadLetter != nil {
+			if v.DeadLetter.Topic == "" && v.DeadLetter.File == "" {
+				err = errors.New("dead_letter requires topic or file: " + v.Name)
+				return
+			}
+			deadLetter = &deadLetterConfig{TopicID: v.DeadLetter.Topic, File: v.DeadLetter.File}
+		}
+
 		// validate ifs
 		ifs := make([]*subIf, 0)
 		{
@@ -107,7 +315,8 @@ func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTes
 				}
 			}
 			if fail {
-				log.Fatal("Failed to validate ifs section")
+				err = errors.New("invalid if section: " + v.Name)
+				return
 			}
 		}
 
@@ -136,10 +345,20 @@ func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTes
 		}
 
 		subz[v.Name] = &subData{
-			Sub:          v.Name,
-			Topic:        "",
-			Command:      v.Command,
-			PassDataVia:  passDataVia,
+			Sub:                    v.Name,
+			Topic:                  "",
+			Command:                v.Command,
+			Sink:                   snk,
+			Format:                 msgFormat,
+			PassDataVia:            passDataVia,
+			NumGoroutines:          v.MaxConcurrent,
+			MaxOutstandingMessages: v.MaxOutstanding,
+			MaxOutstandingBytes:    v.MaxOutstandingBytes,
+			Synchronous:            v.Synchronous,
+			Retry:                  retry,
+			DeadLetter:             deadLetter,
+			ConfigHash: restartFingerprint(v.Command, passDataVia, v.Format, v.Sink, v.HTTP, v.Worker, v.MaxConcurrent,
+				v.MaxOutstanding, v.MaxOutstandingBytes, v.Synchronous, v.Retry, v.DeadLetter, v.Ifs),
 			Ifs:          ifs,
 			Tests:        v.Tests,
 			Cancellation: nil,
@@ -150,51 +369,37 @@ func parseSubsConfig(b []byte) (project string, subz map[string]*subData, hasTes
 		err = errors.New("empty subscriptions list")
 		return
 	}
+
+	// only touch the module-wide exec concurrency limit once the whole config is
+	// known good, so a reload with a bad subscription elsewhere in the file can't
+	// change it out from under the still-running daemon
+	initExecSemaphore(cfg.MaxConcurrentExec)
 	return
 }
 
-func validateSubsConfigIfs(v *ifConfig, index []int) (iff *subIf, gut bool) {
-	iff = nil
-	gut = true
-
-	// value source
-	fieldType := subIfFieldNone
-	fieldName := ""
-	switch {
-	case v.MetaKey != "":
-		fieldType = subIfFieldMetaKey
-		fieldName = v.MetaKey
-	default:
-		log.Error("If at ", index, ": value source undefined")
-		gut = false
-	}
-
-	// pattern
-	if v.Equal == "" {
-		log.Error("If at ", index, ": empty pattern")
-		gut = false
-	}
-	rex, err := regexp.Compile(v.Equal)
-	if err != nil {
-		log.Error("If at ", index, ": invalid pattern: ", err)
-		gut = false
-	}
-
-	iff = &subIf{
-		FieldType: fieldType,
-		FieldName: fieldName,
-		Pattern:   rex,
-		Command:   v.Command,
-		Then:      make([]*subIf, 0),
-	}
-
-	// nested
-	for i, then := range v.Then {
-		subIff, good := validateSubsConfigIfs(then, append(append(index[:0:0], index...), i))
-		iff.Then = append(iff.Then, subIff)
-		if !good {
-			gut = false
-		}
-	}
-	return
+// restartFingerprint hashes every part of a subscription's config that affects its
+// runtime behavior (everything but Name/Disable/Tests). A reload restarts the
+// subscription's goroutine whenever this differs from the running one's, and leaves
+// it alone otherwise. Nothing is ever applied to a live *subData in place: even
+// fields like Retry or DeadLetter that could in principle be swapped without
+// restarting are folded in here too, so this stays the one place deciding whether a
+// config change took effect, instead of also needing every field kept in sync by hand
+func restartFingerprint(command []string, via dataVia, format, sinkType string, http *httpSinkYaml, worker *workerSinkYaml, maxConcurrent, maxOutstanding, maxOutstandingBytes int, synchronous bool, retry *retryYaml, deadLetter *deadLetterYaml, ifs []*ifConfig) string {
+	b, _ := json.Marshal(struct {
+		Command             []string
+		DataVia             dataVia
+		Format              string
+		SinkType            string
+		HTTP                *httpSinkYaml
+		Worker              *workerSinkYaml
+		MaxConcurrent       int
+		MaxOutstanding      int
+		MaxOutstandingBytes int
+		Synchronous         bool
+		Retry               *retryYaml
+		DeadLetter          *deadLetterYaml
+		Ifs                 []*ifConfig
+	}{command, via, format, sinkType, http, worker, maxConcurrent, maxOutstanding, maxOutstandingBytes, synchronous, retry, deadLetter, ifs})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
 }
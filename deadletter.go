@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/sirupsen/logrus"
+)
+
+// deadLetterFileMaxBytes is the size at which a dead letter File is rotated aside
+const deadLetterFileMaxBytes = 10 * 1024 * 1024
+
+// deadLetterConfig is where a subscription's exhausted messages go once Retry.MaxAttempts
+// is reached: republished to Topic with diagnostic attributes, appended as a JSONL
+// record to File, or both
+type deadLetterConfig struct {
+	// TopicID republishes the message to another Pub/Sub topic, tagged with
+	// gsub_dead_letter_* attributes carrying the original sub, exit code and error
+	TopicID string
+	// File appends a JSONL record per dead-lettered message, rotating the file aside
+	// once it exceeds deadLetterFileMaxBytes
+	File string
+
+	mu    sync.Mutex
+	topic *pubsub.Topic
+}
+
+// deadLetterRecord is one line of a dead letter File
+type deadLetterRecord struct {
+	Time       string            `json:"time"`
+	Sub        string            `json:"sub"`
+	MessageID  string            `json:"message_id"`
+	ExitCode   int               `json:"exit_code"`
+	Error      string            `json:"error"`
+	Attributes map[string]string `json:"attributes"`
+	Data       string            `json:"data"`
+}
+
+// send republishes/appends msg per the configured Topic/File. A nil receiver is a no-op,
+// matching subscriptions that have no dead_letter configured
+func (dl *deadLetterConfig) send(ctx context.Context, sub string, msg *pubsub.Message, result cmdResult, log *logrus.Entry) {
+	if dl == nil {
+		return
+	}
+	if dl.TopicID != "" {
+		dl.sendTopic(ctx, sub, msg, result, log)
+	}
+	if dl.File != "" {
+		dl.sendFile(sub, msg, result, log)
+	}
+}
+
+func (dl *deadLetterConfig) sendTopic(ctx context.Context, sub string, msg *pubsub.Message, result cmdResult, log *logrus.Entry) {
+	if pubsubClient == nil {
+		log.Error("Dead letter topic configured but no pub/sub client is available")
+		return
+	}
+
+	dl.mu.Lock()
+	if dl.topic == nil {
+		dl.topic = pubsubClient.Topic(dl.TopicID)
+	}
+	topic := dl.topic
+	dl.mu.Unlock()
+
+	attrs := make(map[string]string, len(msg.Attributes)+3)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs["gsub_dead_letter_sub"] = sub
+	attrs["gsub_dead_letter_exit_code"] = strconv.Itoa(result.exitCode)
+	attrs["gsub_dead_letter_error"] = result.detail
+
+	log.Info("Publishing to dead letter topic ", dl.TopicID)
+	res := topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs})
+	if _, err := res.Get(ctx); err != nil {
+		log.Error("Failed to publish to dead letter topic ", dl.TopicID, ": ", err)
+	}
+}
+
+func (dl *deadLetterConfig) sendFile(sub string, msg *pubsub.Message, result cmdResult, log *logrus.Entry) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	rec := deadLetterRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Sub:        sub,
+		MessageID:  msg.ID,
+		ExitCode:   result.exitCode,
+		Error:      result.detail,
+		Attributes: msg.Attributes,
+		Data:       base64.StdEncoding.EncodeToString(msg.Data),
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Error("Failed to marshal dead letter record: ", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if err := dl.rotateIfNeeded(len(line)); err != nil {
+		log.Error("Failed to rotate dead letter file ", dl.File, ": ", err)
+	}
+
+	f, err := os.OpenFile(dl.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("Failed to open dead letter file ", dl.File, ": ", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		log.Error("Failed to write dead letter record: ", err)
+	}
+}
+
+// rotateIfNeeded renames File aside once writing nextWrite more bytes to it would
+// exceed deadLetterFileMaxBytes
+func (dl *deadLetterConfig) rotateIfNeeded(nextWrite int) error {
+	info, err := os.Stat(dl.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size()+int64(nextWrite) <= deadLetterFileMaxBytes {
+		return nil
+	}
+	rotated := fmt.Sprintf("%s.%s", dl.File, time.Now().UTC().Format("20060102T150405Z"))
+	return os.Rename(dl.File, rotated)
+}
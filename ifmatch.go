@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// ifSource selects which value a leaf ifCond tests
+type ifSource int
+
+const (
+	ifSourceNone ifSource = iota
+	ifSourceMetaKey
+	ifSourceCEField
+	ifSourceJSONPath
+	ifSourceBodyRegex
+	ifSourceAttrExists
+	ifSourceDeliveryAttempt
+)
+
+// ifOp selects how a leaf ifCond's resolved value is tested. Unused by BodyRegex/
+// AttrExists, which are self-contained
+type ifOp int
+
+const (
+	ifOpNone ifOp = iota
+	ifOpEqual
+	ifOpNotEqual
+	ifOpGT
+	ifOpLT
+	ifOpBefore
+	ifOpAfter
+)
+
+// ifCombinator composes Children into a boolean result instead of evaluating a leaf
+type ifCombinator int
+
+const (
+	ifCombinatorNone ifCombinator = iota
+	ifCombinatorAll
+	ifCombinatorAny
+	ifCombinatorNot
+)
+
+// ifCond is one node of a subIf's boolean condition tree: either a combinator over
+// Children, or a leaf testing a Source value with Op
+type ifCond struct {
+	Combinator ifCombinator
+	Children   []*ifCond
+
+	Source ifSource
+	Key    string // metakey name / jsonpath expression / attr_exists key
+
+	Op      ifOp
+	Pattern *regexp.Regexp // Equal, NotEqual, BodyRegex
+	Number  float64        // GT, LT
+	Time    time.Time      // Before, After
+}
+
+// matches evaluates the condition tree against msg/ce/attempt, short-circuiting All/Any
+func (c *ifCond) matches(msg *pubsub.Message, ce map[string]string, attempt int) bool {
+	switch c.Combinator {
+	case ifCombinatorAll:
+		for _, child := range c.Children {
+			if !child.matches(msg, ce, attempt) {
+				return false
+			}
+		}
+		return true
+	case ifCombinatorAny:
+		for _, child := range c.Children {
+			if child.matches(msg, ce, attempt) {
+				return true
+			}
+		}
+		return false
+	case ifCombinatorNot:
+		return !c.Children[0].matches(msg, ce, attempt)
+	}
+
+	switch c.Source {
+	case ifSourceBodyRegex:
+		return c.Pattern.Match(msg.Data)
+	case ifSourceAttrExists:
+		_, ok := msg.Attributes[c.Key]
+		return ok
+	}
+
+	value, ok := c.resolve(msg, ce, attempt)
+	if !ok {
+		return false
+	}
+
+	switch c.Op {
+	case ifOpEqual:
+		return c.Pattern.MatchString(value)
+	case ifOpNotEqual:
+		return !c.Pattern.MatchString(value)
+	case ifOpGT, ifOpLT:
+		num, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		if c.Op == ifOpGT {
+			return num > c.Number
+		}
+		return num < c.Number
+	case ifOpBefore, ifOpAfter:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false
+		}
+		if c.Op == ifOpBefore {
+			return t.Before(c.Time)
+		}
+		return t.After(c.Time)
+	}
+	return false
+}
+
+// resolve produces the string value a non-self-contained leaf tests its Op against
+func (c *ifCond) resolve(msg *pubsub.Message, ce map[string]string, attempt int) (string, bool) {
+	switch c.Source {
+	case ifSourceMetaKey:
+		v, ok := msg.Attributes[c.Key]
+		return v, ok
+	case ifSourceCEField:
+		v, ok := ce[c.Key]
+		return v, ok
+	case ifSourceJSONPath:
+		v, ok := jsonPathValue(msg.Data, c.Key)
+		if !ok {
+			return "", false
+		}
+		return jsonValueToString(v), true
+	case ifSourceDeliveryAttempt:
+		return strconv.Itoa(attempt), true
+	default:
+		// no explicit source: Before/After default to the message's publish time
+		return msg.PublishTime.UTC().Format(time.RFC3339), true
+	}
+}
+
+// eval walks the subIf tree, invoking cbk for every node whose Cond matches and
+// recursing into Then regardless of whether the children have their own conditions
+func (iff *subIf) eval(msg *pubsub.Message, ce map[string]string, attempt int, index []int, cbk func(*subIf, []int)) {
+	if !iff.Cond.matches(msg, ce, attempt) {
+		return
+	}
+	cbk(iff, index)
+	for i, v := range iff.Then {
+		v.eval(msg, ce, attempt, append(append(index[:0:0], index...), i), cbk)
+	}
+}
+
+// jsonPathValue evaluates a small dotted/bracketed path (`$.a.b[0].c`) against data
+// parsed as JSON, returning the value at that path
+func jsonPathValue(data []byte, path string) (interface{}, bool) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, false
+	}
+
+	cur := root
+	for _, seg := range jsonPathSegments(path) {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			nv, ok := v[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = nv
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			cur = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// jsonPathSegments splits `$.a.b[0].c` into ["a", "b", "0", "c"]
+func jsonPathSegments(path string) []string {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil
+	}
+
+	var segs []string
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			i := strings.IndexByte(part, '[')
+			if i < 0 {
+				segs = append(segs, part)
+				break
+			}
+			if i > 0 {
+				segs = append(segs, part[:i])
+			}
+			j := strings.IndexByte(part, ']')
+			if j < 0 {
+				break
+			}
+			segs = append(segs, part[i+1:j])
+			part = part[j+1:]
+		}
+	}
+	return segs
+}
+
+// jsonValueToString renders a decoded JSON value (string/float64/bool/nil) as a string
+// for use against regex/numeric/time operators
+func jsonValueToString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+// validateSubsConfigIfs turns one `if` yaml entry into a subIf, recursing into Then.
+// gut is false if any condition in the subtree failed validation
+func validateSubsConfigIfs(v *ifConfig, index []int) (iff *subIf, gut bool) {
+	cond, gut := validateIfCondition(v, index)
+
+	iff = &subIf{
+		Cond:    cond,
+		Command: v.Command,
+		Then:    make([]*subIf, 0),
+	}
+
+	for i, then := range v.Then {
+		subIff, good := validateSubsConfigIfs(then, append(append(index[:0:0], index...), i))
+		iff.Then = append(iff.Then, subIff)
+		if !good {
+			gut = false
+		}
+	}
+	return
+}
+
+// validateIfCondition builds the ifCond for a single yaml condition node: either a
+// combinator (all/any/not) over nested conditions, or a leaf source+operator
+func validateIfCondition(v *ifConfig, index []int) (*ifCond, bool) {
+	gut := true
+
+	switch {
+	case len(v.All) > 0:
+		children := make([]*ifCond, 0, len(v.All))
+		for i, child := range v.All {
+			c, ok := validateIfCondition(child, append(append(index[:0:0], index...), i))
+			children = append(children, c)
+			if !ok {
+				gut = false
+			}
+		}
+		return &ifCond{Combinator: ifCombinatorAll, Children: children}, gut
+
+	case len(v.Any) > 0:
+		children := make([]*ifCond, 0, len(v.Any))
+		for i, child := range v.Any {
+			c, ok := validateIfCondition(child, append(append(index[:0:0], index...), i))
+			children = append(children, c)
+			if !ok {
+				gut = false
+			}
+		}
+		return &ifCond{Combinator: ifCombinatorAny, Children: children}, gut
+
+	case v.Not != nil:
+		c, ok := validateIfCondition(v.Not, append(append(index[:0:0], index...), 0))
+		return &ifCond{Combinator: ifCombinatorNot, Children: []*ifCond{c}}, ok
+	}
+
+	cond := &ifCond{}
+
+	// value source
+	sources := 0
+	switch {
+	case v.MetaKey != "":
+		cond.Source = ifSourceMetaKey
+		cond.Key = v.MetaKey
+		sources++
+	case v.CEField != "":
+		cond.Source = ifSourceCEField
+		cond.Key = v.CEField
+		sources++
+	case v.JSONPath != "":
+		cond.Source = ifSourceJSONPath
+		cond.Key = v.JSONPath
+		sources++
+	case v.AttrExists != "":
+		cond.Source = ifSourceAttrExists
+		cond.Key = v.AttrExists
+		sources++
+	case v.DeliveryAttempt:
+		cond.Source = ifSourceDeliveryAttempt
+		sources++
+	}
+	if v.BodyRegex != "" {
+		sources++
+		rex, err := regexp.Compile(v.BodyRegex)
+		if err != nil {
+			log.Error("If at ", index, ": invalid bodyregex: ", err)
+			gut = false
+		}
+		cond.Source = ifSourceBodyRegex
+		cond.Pattern = rex
+	}
+	if sources > 1 {
+		log.Error("If at ", index, ": multiple value sources set")
+		gut = false
+	}
+
+	// bodyregex/attr_exists are self-contained; no operator to parse
+	if cond.Source == ifSourceBodyRegex || cond.Source == ifSourceAttrExists {
+		return cond, gut
+	}
+
+	// operator
+	ops := 0
+	switch {
+	case v.Equal != "":
+		ops++
+		rex, err := regexp.Compile(v.Equal)
+		if err != nil {
+			log.Error("If at ", index, ": invalid equal pattern: ", err)
+			gut = false
+		}
+		cond.Op = ifOpEqual
+		cond.Pattern = rex
+	case v.NotEqual != "":
+		ops++
+		rex, err := regexp.Compile(v.NotEqual)
+		if err != nil {
+			log.Error("If at ", index, ": invalid not_equal pattern: ", err)
+			gut = false
+		}
+		cond.Op = ifOpNotEqual
+		cond.Pattern = rex
+	case v.GT != "":
+		ops++
+		num, err := strconv.ParseFloat(v.GT, 64)
+		if err != nil {
+			log.Error("If at ", index, ": invalid gt number: ", err)
+			gut = false
+		}
+		cond.Op = ifOpGT
+		cond.Number = num
+	case v.LT != "":
+		ops++
+		num, err := strconv.ParseFloat(v.LT, 64)
+		if err != nil {
+			log.Error("If at ", index, ": invalid lt number: ", err)
+			gut = false
+		}
+		cond.Op = ifOpLT
+		cond.Number = num
+	case v.Before != "":
+		ops++
+		t, err := time.Parse(time.RFC3339, v.Before)
+		if err != nil {
+			log.Error("If at ", index, ": invalid before time: ", err)
+			gut = false
+		}
+		cond.Op = ifOpBefore
+		cond.Time = t
+	case v.After != "":
+		ops++
+		t, err := time.Parse(time.RFC3339, v.After)
+		if err != nil {
+			log.Error("If at ", index, ": invalid after time: ", err)
+			gut = false
+		}
+		cond.Op = ifOpAfter
+		cond.Time = t
+	}
+
+	if ops != 1 {
+		log.Error("If at ", index, ": exactly one operator (equal/not_equal/gt/lt/before/after) is required")
+		gut = false
+	}
+	if sources == 0 && cond.Op != ifOpBefore && cond.Op != ifOpAfter {
+		log.Error("If at ", index, ": value source undefined")
+		gut = false
+	}
+
+	return cond, gut
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -25,10 +26,12 @@ var (
 )
 
 var (
-	log       *logrus.Logger
-	projectID string
-	subz      map[string]*subData
-	stopOnce  = sync.Once{}
+	log          *logrus.Logger
+	projectID    string
+	subz         map[string]*subData
+	stopOnce     = sync.Once{}
+	pubsubClient *pubsub.Client
+	rootCtx      context.Context
 )
 
 func main() {
@@ -125,14 +128,18 @@ func onStart() {
 		if err != nil {
 			log.Fatal("Failed to read subscriptions: ", err)
 		}
-		projID, subzMap, hasTests, err := parseSubsConfig(b)
+		projID, subzMap, hasTests, metricsAddr, configHash, err := parseSubsConfig(b)
 		if err != nil {
 			log.Fatal("Failed to parse subscriptions: ", err)
 		}
 		projectID = projID
 		subz = subzMap
 		testing = hasTests
-		log.Info("Project ", projID, ", ", len(subz), " subscriptions")
+		logConfigSummary(configHash, subz)
+
+		if metricsAddr != "" {
+			startMetricsServer(metricsAddr)
+		}
 	}
 
 	// optional creds
@@ -146,94 +153,143 @@ func onStart() {
 		clientOpts = append(clientOpts, option.WithCredentialsJSON(b))
 	}
 
+	rootCtx = context.Background()
+
 	// client
-	var client *pubsub.Client
-	ctx := context.Background()
 	if !testing {
 		log.Debug("Setting up client")
-		c, err := pubsub.NewClient(ctx, projectID, clientOpts...)
+		c, err := pubsub.NewClient(rootCtx, projectID, clientOpts...)
 		if err != nil {
 			log.Fatal("Failed to create pub/sub client: ", err)
 		}
 		defer c.Close()
-		client = c
+		pubsubClient = c
 	}
 
 	// check subscriptions
 	if !testing {
 		log.Debug("Checking subscriptions")
-		for _, v := range subz {
-			sub := client.Subscription(v.Sub)
-			ok, err := sub.Exists(ctx)
-			if err != nil {
-				log.Fatal("Failed to check subscription ", v.Sub, ":", err)
-			}
-			if !ok {
-				log.Fatal("Subscription ", v.Sub, " does not exist. Create it first in Google Cloud console")
-			}
-
-			scfg, err := sub.Config(ctx)
-			if err != nil {
-				log.Fatal("Failed to get subscription ", v.Sub, " config: ", err)
-			}
-			v.Topic = scfg.Topic.ID()
+		if err := resolveSubscriptions(rootCtx, subz); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	wg := sync.WaitGroup{}
-	for _, v := range subz {
-		logsub := log.WithField("sub", v.Sub)
-
-		subctx, cancel := context.WithCancel(ctx)
-		v.Cancellation = cancel
-
-		if testing {
+	if testing {
+		for _, v := range subz {
+			logsub := log.WithField("sub", v.Sub)
 			for i, test := range v.Tests {
 				logsub.Trace("Test #", i+1)
 				logmsg := log.WithField("msg", test.Message.ID)
-				v.receiveMessage(subctx, test.Message, logmsg)
-			}
-			continue
-		}
-
-		wg.Add(1)
-		go func(ctx context.Context, subdata *subData, log *logrus.Entry) {
-			defer wg.Done()
-			defer onStop()
-			defer log.Trace("Unsubscribed")
-			log.Trace("Subscribed")
-			sub := client.Subscription(subdata.Sub)
-			if err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-				logmsg := log.WithField("msg", msg.ID)
-				if subdata.receiveMessage(ctx, msg, logmsg) {
-					msg.Ack()
-				} else {
-					msg.Nack()
-				}
-			}); err != nil {
-				log.Error("Failed to receive message: ", err)
+				v.receiveMessage(rootCtx, test.Message, logmsg)
 			}
-		}(subctx, v, logsub)
+		}
+		log.Info("Stopped")
+		return
+	}
+
+	runningMu.Lock()
+	for _, v := range subz {
+		running[v.Sub] = startSubscription(rootCtx, pubsubClient, v)
 	}
+	runningMu.Unlock()
 
 	go func() {
 		sigchan := make(chan os.Signal, 1)
+		if runtime.GOOS == "windows" {
+			log.Warning("Hot-reload on SIGHUP is not available on Windows; restart the service to pick up ", *argSubscriptions, " changes (see reload_signal_windows.go)")
+		}
+		notifyReload(sigchan)
 		signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigchan
-		onStop()
+		for sig := range sigchan {
+			if isReloadSignal(sig) {
+				reloadConfig()
+				continue
+			}
+			onStop()
+		}
 	}()
 
-	wg.Wait()
+	runWG.Wait()
 	log.Info("Stopped")
 }
 
+// startSubscription starts pulling subdata's subscription in its own goroutine under a
+// child of parent, returning a handle that lets the caller cancel it (and wait for its
+// in-flight messages to drain) independently of every other running subscription
+func startSubscription(parent context.Context, client *pubsub.Client, subdata *subData) *subRun {
+	ctx, cancel := context.WithCancel(parent)
+	subdata.Cancellation = cancel
+	run := &subRun{subdata: subdata, cancel: cancel, done: make(chan struct{})}
+
+	runWG.Add(1)
+	go func() {
+		defer runWG.Done()
+		defer close(run.done)
+
+		logsub := log.WithField("sub", subdata.Sub)
+		logsub.Trace("Subscribed")
+		defer logsub.Trace("Unsubscribed")
+
+		sub := client.Subscription(subdata.Sub)
+		if subdata.NumGoroutines > 0 {
+			sub.ReceiveSettings.NumGoroutines = subdata.NumGoroutines
+		}
+		if subdata.MaxOutstandingMessages > 0 {
+			sub.ReceiveSettings.MaxOutstandingMessages = subdata.MaxOutstandingMessages
+		}
+		if subdata.MaxOutstandingBytes > 0 {
+			sub.ReceiveSettings.MaxOutstandingBytes = subdata.MaxOutstandingBytes
+		}
+		if err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			logmsg := logsub.WithField("msg", msg.ID)
+			if subdata.Synchronous {
+				subdata.syncMu.Lock()
+				defer subdata.syncMu.Unlock()
+			}
+			incInFlight()
+			defer decInFlight()
+			if subdata.receiveMessage(ctx, msg, logmsg) {
+				msg.Ack()
+			} else {
+				msg.Nack()
+			}
+		}); err != nil {
+			logsub.Error("Failed to receive message: ", err)
+		}
+	}()
+
+	return run
+}
+
+// resolveSubscriptions checks that every subscription in subz exists in Google Cloud
+// and fills in its Topic, Pub/Sub.Subscription.Config round trip
+func resolveSubscriptions(ctx context.Context, subz map[string]*subData) error {
+	for _, v := range subz {
+		sub := pubsubClient.Subscription(v.Sub)
+		ok, err := sub.Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check subscription %s: %v", v.Sub, err)
+		}
+		if !ok {
+			return fmt.Errorf("subscription %s does not exist. Create it first in Google Cloud console", v.Sub)
+		}
+
+		scfg, err := sub.Config(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription %s config: %v", v.Sub, err)
+		}
+		v.Topic = scfg.Topic.ID()
+	}
+	return nil
+}
+
 func onStop() {
 	stopOnce.Do(func() {
 		log.Info("Cancelling all subscriptions...")
-		for _, v := range subz {
-			if v.Cancellation != nil {
-				v.Cancellation()
-			}
+		runningMu.Lock()
+		defer runningMu.Unlock()
+		for _, run := range running {
+			run.cancel()
 		}
 	})
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// inFlightMessages counts messages currently being processed across all subscriptions
+var inFlightMessages int64
+
+func incInFlight() { atomic.AddInt64(&inFlightMessages, 1) }
+func decInFlight() { atomic.AddInt64(&inFlightMessages, -1) }
+
+// startMetricsServer serves a minimal Prometheus text-exposition endpoint at /metrics
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP gpubsub_in_flight_messages Messages currently being processed")
+		fmt.Fprintln(w, "# TYPE gpubsub_in_flight_messages gauge")
+		fmt.Fprintf(w, "gpubsub_in_flight_messages %d\n", atomic.LoadInt64(&inFlightMessages))
+	})
+	log.Info("Serving metrics on ", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error("Metrics server failed: ", err)
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// subRun is a running subscription: its subData, the context.CancelFunc that stops it,
+// and a channel closed once its Receive loop (and therefore every in-flight message
+// callback) has fully returned
+type subRun struct {
+	subdata *subData
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+var (
+	runningMu sync.Mutex
+	running   = make(map[string]*subRun)
+	runWG     sync.WaitGroup
+)
+
+// reloadConfig re-reads *argSubscriptions and diffs it against the running
+// subscriptions: unchanged ones (by ConfigHash) are left alone, changed ones are
+// cancelled and restarted, removed ones are cancelled, and newly added ones are
+// started. Every cancellation waits on subRun.done first, so in-flight messages
+// finish before the old subscription's slot is replaced
+func reloadConfig() {
+	log.Info("Reloading subscriptions from ", *argSubscriptions)
+
+	b, err := ioutil.ReadFile(*argSubscriptions)
+	if err != nil {
+		log.Error("Reload failed, keeping current config: ", err)
+		return
+	}
+	newProjectID, newSubz, hasTests, _, configHash, err := parseSubsConfig(b)
+	if err != nil {
+		log.Error("Reload failed, keeping current config: ", err)
+		return
+	}
+	if hasTests {
+		log.Error("Reload failed: config has a tests section, which only applies at startup")
+		return
+	}
+	if newProjectID != projectID {
+		log.Error("Reload failed: project changed from ", projectID, " to ", newProjectID, " (requires a restart)")
+		return
+	}
+	if err := resolveSubscriptions(rootCtx, newSubz); err != nil {
+		log.Error("Reload failed, keeping current config: ", err)
+		return
+	}
+
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	for name, run := range running {
+		if _, ok := newSubz[name]; ok {
+			continue
+		}
+		log.Info("Reload: stopping removed subscription ", name)
+		run.cancel()
+		<-run.done
+		delete(running, name)
+	}
+
+	for name, sd := range newSubz {
+		old, ok := running[name]
+		if ok && old.subdata.ConfigHash == sd.ConfigHash {
+			log.Debug("Reload: ", name, " unchanged")
+			continue
+		}
+		if ok {
+			log.Info("Reload: restarting changed subscription ", name)
+			old.cancel()
+			<-old.done
+		} else {
+			log.Info("Reload: starting new subscription ", name)
+		}
+		running[name] = startSubscription(rootCtx, pubsubClient, sd)
+	}
+
+	subz = newSubz
+	logConfigSummary(configHash, subz)
+}
+
+// logConfigSummary surfaces the loaded config hash and per-subscription restart
+// fingerprints at Info level, so an operator can confirm from the logs alone that a
+// reload picked up the change they expected
+func logConfigSummary(configHash string, subz map[string]*subData) {
+	names := make([]string, 0, len(subz))
+	for name := range subz {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := make([]string, 0, len(names))
+	for _, name := range names {
+		rules = append(rules, name+"="+subz[name].ConfigHash[:12])
+	}
+
+	log.Info("Config ", configHash[:12], " loaded, ", len(subz), " subscriptions: ", strings.Join(rules, ", "))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload arranges for SIGHUP to trigger a config reload
+func notifyReload(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
+
+// isReloadSignal reports whether sig is the reload trigger registered by notifyReload
+func isReloadSignal(sig os.Signal) bool {
+	return sig == syscall.SIGHUP
+}
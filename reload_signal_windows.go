@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// notifyReload is a deliberate no-op on Windows, not an oversight: kardianos/service
+// v1.0.0's Windows backend (service_windows.go) only forwards Interrogate/Stop/Shutdown
+// to application code, with no custom service control code (e.g. ParamChange) an
+// operator could send to ask for a reload, and os/signal has no SIGHUP equivalent
+// there either. Wiring this up for real means either vendoring a newer
+// kardianos/service that exposes a custom control code, or replacing it with a
+// hand-rolled Windows service loop - both bigger than this change. Hot-reload is
+// unix-only until one of those happens; main.go logs a warning on startup so this
+// isn't silent to an operator running the Windows build
+func notifyReload(c chan os.Signal) {}
+
+// isReloadSignal never matches on Windows; see notifyReload
+func isReloadSignal(sig os.Signal) bool {
+	return false
+}
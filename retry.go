@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// retryPolicy governs local redelivery backoff for a subscription whose command/sink
+// keeps failing. Pub/Sub itself owns redelivery (gpubsub nacks the message); this only
+// sleeps before re-processing a redelivered attempt and caps how many it tolerates
+type retryPolicy struct {
+	// MaxAttempts is the delivery attempt (from msg.DeliveryAttempt) at which gpubsub
+	// stops nacking and hands the message to DeadLetter instead. 0 means unlimited
+	MaxAttempts int
+	// InitialBackoff is the sleep applied before the second delivery attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the sleep regardless of attempt count. 0 means uncapped
+	MaxBackoff time.Duration
+	// Multiplier scales InitialBackoff by itself for every attempt beyond the second.
+	// <= 0 behaves as 1 (constant backoff)
+	Multiplier float64
+	// Jitter randomizes the computed backoff by +/- this fraction (0..1) to avoid
+	// thundering-herd redeliveries across subscribers
+	Jitter float64
+}
+
+// backoff returns how long to sleep before delivery attempt n+1, where n is the number
+// of attempts already made (1 for the first retry). A nil receiver or unset
+// InitialBackoff means no backoff is applied
+func (rp *retryPolicy) backoff(n int) time.Duration {
+	if rp == nil || rp.InitialBackoff <= 0 {
+		return 0
+	}
+
+	mult := rp.Multiplier
+	if mult <= 0 {
+		mult = 1
+	}
+
+	d := float64(rp.InitialBackoff)
+	for i := 1; i < n; i++ {
+		d *= mult
+	}
+	if rp.MaxBackoff > 0 && d > float64(rp.MaxBackoff) {
+		d = float64(rp.MaxBackoff)
+	}
+
+	if rp.Jitter > 0 {
+		d += d * rp.Jitter * (rand.Float64()*2 - 1)
+		if d < 0 {
+			d = 0
+		}
+	}
+
+	return time.Duration(d)
+}
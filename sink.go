@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sinkType selects where a subscription dispatches its matched messages
+type sinkType string
+
+const (
+	// sinkExec runs Command through os/exec, once per message (default)
+	sinkExec sinkType = "exec"
+	// sinkHTTP POSTs the message to a URL
+	sinkHTTP sinkType = "http"
+	// sinkWorker feeds messages to a persistent long-running child process over stdin
+	sinkWorker sinkType = "worker"
+)
+
+// sink holds the resolved dispatch target of a subscription
+type sink struct {
+	Type   sinkType
+	HTTP   *httpSink
+	Worker *workerSink
+}
+
+// httpSink POSTs message data to a URL and acks/nacks based on the response status
+type httpSink struct {
+	URL      string
+	Headers  map[string]string
+	Encoding string // raw, base64, json
+	client   *http.Client
+}
+
+// jsonSinkBody is the body shape used when httpSink.Encoding is `json`
+type jsonSinkBody struct {
+	ID         string            `json:"id"`
+	Attributes map[string]string `json:"attributes"`
+	Data       string            `json:"data"`
+}
+
+// newHTTPSink builds a sink dispatching to an HTTP endpoint
+func newHTTPSink(cfg *httpSinkYaml) *sink {
+	return &sink{
+		Type: sinkHTTP,
+		HTTP: &httpSink{
+			URL:      cfg.URL,
+			Headers:  cfg.Headers,
+			Encoding: cfg.Encoding,
+			client:   &http.Client{Timeout: 30 * time.Second},
+		},
+	}
+}
+
+func (h *httpSink) perform(replaces map[string]string, id string, attrs map[string]string, data []byte, log *logrus.Entry) cmdResult {
+	replacer := newCommandReplacer(replaces)
+	url := replacer.Replace(h.URL)
+
+	var body []byte
+	switch h.Encoding {
+	case "", "raw":
+		body = data
+	case "base64":
+		body = []byte(base64.StdEncoding.EncodeToString(data))
+	case "json":
+		b, err := json.Marshal(jsonSinkBody{
+			ID:         id,
+			Attributes: attrs,
+			Data:       base64.StdEncoding.EncodeToString(data),
+		})
+		if err != nil {
+			log.Error("Failed to marshal http sink body: ", err)
+			return cmdResult{ok: false, detail: err.Error()}
+		}
+		body = b
+	default:
+		log.Error("Unknown http sink encoding: ", h.Encoding)
+		return cmdResult{ok: false, detail: "unknown http sink encoding: " + h.Encoding}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Error("Failed to build http sink request: ", err)
+		return cmdResult{ok: false, detail: err.Error()}
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, replacer.Replace(v))
+	}
+
+	log.Info("Posting to ", url)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Error("Http sink request failed: ", err)
+		return cmdResult{ok: false, detail: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	log.Info("Http sink responded ", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return cmdResult{ok: false, detail: fmt.Sprintf("http sink responded %d", resp.StatusCode)}
+	}
+	return cmdResult{ok: true}
+}
+
+// workerSink keeps a single child process alive and feeds it messages over stdin,
+// each one framed with a 4-byte big-endian length prefix, avoiding fork-per-message
+type workerSink struct {
+	Command subCommand
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	exited bool
+}
+
+// newWorkerSink builds a sink dispatching to a persistent worker process
+func newWorkerSink(cfg *workerSinkYaml) *sink {
+	return &sink{
+		Type:   sinkWorker,
+		Worker: &workerSink{Command: cfg.Command},
+	}
+}
+
+// ensureStarted spawns the worker process if it isn't already running
+func (w *workerSink) ensureStarted(log *logrus.Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cmd != nil && !w.exited {
+		return nil
+	}
+
+	cmd := exec.Command(strings.TrimSpace(w.Command[0]), w.Command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = log.WriterLevel(logrus.InfoLevel)
+	cmd.Stderr = log.WriterLevel(logrus.ErrorLevel)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Info("Worker sink started: ", w.Command)
+	w.cmd = cmd
+	w.stdin = stdin
+	w.exited = false
+	go w.wait(cmd, log)
+	return nil
+}
+
+// wait blocks until cmd exits, reaping it (avoiding a zombie process on Unix) and
+// marking the worker as exited so the next perform respawns it
+func (w *workerSink) wait(cmd *exec.Cmd, log *logrus.Entry) {
+	err := cmd.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cmd == cmd {
+		w.exited = true
+	}
+	log.Warning("Worker sink exited: ", err)
+}
+
+func (w *workerSink) perform(replaces map[string]string, data []byte, log *logrus.Entry) cmdResult {
+	if err := w.ensureStarted(log); err != nil {
+		log.Error("Failed to start worker sink: ", err)
+		return cmdResult{ok: false, detail: err.Error()}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(data)))
+	copy(frame[4:], data)
+	if _, err := w.stdin.Write(frame); err != nil {
+		log.Error("Worker sink write failed: ", err)
+		return cmdResult{ok: false, detail: err.Error()}
+	}
+	return cmdResult{ok: true}
+}
+
+// newCommandReplacer builds the GSUB_* strings.Replacer shared by every sink
+func newCommandReplacer(replaces map[string]string) *strings.Replacer {
+	arr := make([]string, 0, 2*len(replaces))
+	for k, v := range replaces {
+		arr = append(arr, k, v)
+	}
+	return strings.NewReplacer(arr...)
+}
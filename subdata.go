@@ -1,28 +1,45 @@
 package main
 
 import (
-	"fmt"
 	"context"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/sirupsen/logrus"
 )
 
 type subData struct {
-	Sub          string
-	Topic        string
-	Command      subCommand
-	PassDataVia  dataVia
+	Sub                    string
+	Topic                  string
+	Command                subCommand
+	Sink                   *sink
+	Format                 messageFormat
+	PassDataVia            dataVia
+	NumGoroutines          int
+	MaxOutstandingMessages int
+	MaxOutstandingBytes    int
+	Synchronous            bool
+	Retry                  *retryPolicy
+	DeadLetter             *deadLetterConfig
+	// ConfigHash fingerprints this subscription's entire yaml config, letting a reload
+	// tell whether it's unchanged (left running) or needs restarting. See
+	// restartFingerprint for why this covers every field rather than just the ones a
+	// restart is strictly required for
+	ConfigHash   string
 	Ifs          []*subIf
 	Tests        []*subDataTest
 	Cancellation context.CancelFunc
+	syncMu       sync.Mutex
+	attemptsMu   sync.Mutex
+	attempts     map[string]int
 }
 
 type dataVia string
@@ -35,20 +52,11 @@ const (
 )
 
 type subIf struct {
-	FieldType subIfField
-	FieldName string
-	Pattern   *regexp.Regexp
-	Command   subCommand
-	Then      []*subIf
+	Cond    *ifCond
+	Command subCommand
+	Then    []*subIf
 }
 
-type subIfField int
-
-const (
-	subIfFieldNone subIfField = iota
-	subIfFieldMetaKey
-)
-
 type subDataTest struct {
 	Data    string            `yaml:"data"`
 	Meta    map[string]string `yaml:"meta"`
@@ -57,11 +65,89 @@ type subDataTest struct {
 
 type subCommand []string
 
+// cmdResult carries the outcome of a dispatch to a sink, along with enough
+// detail (exit code, stderr tail) for the DeadLetter to attach diagnostics
+type cmdResult struct {
+	ok       bool
+	detail   string
+	exitCode int
+}
+
 // ---
 
+// receiveMessage processes msg, applying this subscription's Retry backoff policy on
+// redelivery and handing off to DeadLetter once Retry.MaxAttempts is exhausted. It
+// reports whether the message should be acked (true) or nacked (false) for redelivery.
+//
+// The installed pubsub client predates Message.DeliveryAttempt, so attempts are
+// counted locally per msg.ID instead of trusting the server's redelivery count
 func (sd *subData) receiveMessage(ctx context.Context, msg *pubsub.Message, log *logrus.Entry) bool {
+	attempt := sd.trackAttempt(msg.ID)
+
+	if attempt > 1 {
+		if d := sd.Retry.backoff(attempt - 1); d > 0 {
+			log.Debug("Backing off ", d, " before attempt ", attempt)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+
+	result := sd.process(ctx, msg, attempt, log)
+	if result.ok {
+		sd.clearAttempts(msg.ID)
+		return true
+	}
+
+	if sd.Retry != nil && sd.Retry.MaxAttempts > 0 && attempt >= sd.Retry.MaxAttempts {
+		log.Warning("Giving up after ", attempt, " attempts: ", result.detail)
+		sd.DeadLetter.send(ctx, sd.Sub, msg, result, log)
+		sd.clearAttempts(msg.ID)
+		return true
+	}
+
+	return false
+}
+
+// trackAttempt records another delivery attempt for msg.ID and returns the running count
+func (sd *subData) trackAttempt(id string) int {
+	sd.attemptsMu.Lock()
+	defer sd.attemptsMu.Unlock()
+	if sd.attempts == nil {
+		sd.attempts = make(map[string]int)
+	}
+	sd.attempts[id]++
+	return sd.attempts[id]
+}
+
+// clearAttempts drops the attempt count for msg.ID once it's been acked either way
+func (sd *subData) clearAttempts(id string) {
+	sd.attemptsMu.Lock()
+	defer sd.attemptsMu.Unlock()
+	delete(sd.attempts, id)
+}
+
+// process dispatches msg to the root command and any matching ifs, returning whether
+// every dispatch succeeded and, if not, diagnostics for the last failure. attempt is
+// this message's locally tracked delivery attempt, exposed to ifs via `delivery_attempt`
+func (sd *subData) process(ctx context.Context, msg *pubsub.Message, attempt int, log *logrus.Entry) cmdResult {
 	log.Debug("New message ", len(msg.Data), " B length and ", len(msg.Attributes), " attrs")
 
+	// cloudevents envelope
+	data := msg.Data
+	var ce *cloudEvent
+	if sd.Format == formatCloudEvents {
+		parsedCE, rawData, err := parseCloudEvent(msg)
+		if err != nil {
+			log.Error("Failed to parse cloudevents envelope: ", err)
+			return cmdResult{ok: false, detail: err.Error()}
+		}
+		ce = parsedCE
+		data = rawData
+	}
+
 	// command args replaces
 	commandReplaces := make(map[string]string)
 	commandReplaces["GSUB_SUB"] = sd.Sub
@@ -69,15 +155,22 @@ func (sd *subData) receiveMessage(ctx context.Context, msg *pubsub.Message, log
 	for metak, metav := range msg.Attributes {
 		commandReplaces["GSUB_META_"+strings.ReplaceAll(metak, " ", "_")] = metav
 	}
+	var ceFields map[string]string
+	if ce != nil {
+		ceFields = ce.fields()
+		for cek, cev := range ceFields {
+			commandReplaces["GSUB_CE_"+strings.ToUpper(cek)] = cev
+		}
+	}
 
 	// msg data => file
 	var dataFile string
 	if sd.PassDataVia == dataViaFile {
 		dataFile = path.Join(os.TempDir(), "gpubsub_message_"+msg.ID)
 		log.Trace("Writing data file ", dataFile)
-		if err := ioutil.WriteFile(dataFile, msg.Data, 0600); err != nil {
+		if err := ioutil.WriteFile(dataFile, data, 0600); err != nil {
 			log.Error("Failed to write data file: ", err)
-			return false
+			return cmdResult{ok: false, detail: err.Error()}
 		}
 		defer func() {
 			log.Trace("Removing data file")
@@ -88,49 +181,75 @@ func (sd *subData) receiveMessage(ctx context.Context, msg *pubsub.Message, log
 
 	// msg data => var
 	if sd.PassDataVia == dataViaVar {
-		commandReplaces["GSUB_DATA"] = base64.StdEncoding.EncodeToString(msg.Data)
+		commandReplaces["GSUB_DATA"] = base64.StdEncoding.EncodeToString(data)
 	}
 
 	// msg data => pipe
 	var passBytesViaPipe []byte
 	if sd.PassDataVia == dataViaPipe {
-		passBytesViaPipe = msg.Data
+		passBytesViaPipe = data
 	}
 
 	// ---
 
+	result := cmdResult{ok: true}
+
+	// ifs have a different meaning depending on the sink: for `exec` each match runs
+	// its own (possibly distinct) command, in addition to the unconditional root
+	// command. For `http`/`worker` there's a single configured target, not one per if,
+	// so ifs there are purely a filter: the target fires at most once per message
+	ifMatched := false
+
 	// perform root command
-	if !sd.Command.empty() {
-		sd.Command.perform(commandReplaces, passBytesViaPipe, log.WithField("cmd", "root"))
+	if sd.Sink.Type == sinkExec {
+		if !sd.Command.empty() {
+			if r := sd.dispatch(sd.Command, msg, data, commandReplaces, passBytesViaPipe, log.WithField("cmd", "root")); !r.ok {
+				result = r
+			}
+		}
+	} else if len(sd.Ifs) == 0 {
+		if r := sd.dispatch(sd.Command, msg, data, commandReplaces, passBytesViaPipe, log.WithField("cmd", "root")); !r.ok {
+			result = r
+		}
 	}
 
 	// ifs
 	if len(sd.Ifs) > 0 {
 		for i, iff := range sd.Ifs {
-			iff.eval(msg, []int{i}, func(iff *subIf, index []int) {
+			iff.eval(msg, ceFields, attempt, []int{i}, func(iff *subIf, index []int) {
 				log.Debug("If at ", index, " triggered")
-				iff.Command.perform(commandReplaces, passBytesViaPipe, log.WithField("cmd", fmt.Sprintf("if%v", index)))
+				ifMatched = true
+				if sd.Sink.Type != sinkExec {
+					return
+				}
+				if r := sd.dispatch(iff.Command, msg, data, commandReplaces, passBytesViaPipe, log.WithField("cmd", fmt.Sprintf("if%v", index))); !r.ok {
+					result = r
+				}
 			})
 		}
+		if ifMatched && sd.Sink.Type != sinkExec {
+			if r := sd.dispatch(sd.Command, msg, data, commandReplaces, passBytesViaPipe, log.WithField("cmd", "root")); !r.ok {
+				result = r
+			}
+		}
 	}
 
-	return true
+	return result
 }
 
-func (iff *subIf) eval(msg *pubsub.Message, index []int, cbk func(*subIf, []int)) {
-	value := ""
-	switch iff.FieldType {
-	case subIfFieldMetaKey:
-		value = msg.Attributes[iff.FieldName]
+// dispatch sends the message to the subscription's configured sink (exec/http/worker)
+// and reports whether it should be acked (true) or nacked (false) for redelivery
+func (sd *subData) dispatch(sc subCommand, msg *pubsub.Message, data []byte, replaces map[string]string, passViaPipe []byte, log *logrus.Entry) cmdResult {
+	switch sd.Sink.Type {
+	case sinkHTTP:
+		return sd.Sink.HTTP.perform(replaces, msg.ID, msg.Attributes, data, log)
+	case sinkWorker:
+		return sd.Sink.Worker.perform(replaces, data, log)
 	default:
-		return
-	}
-	if !iff.Pattern.MatchString(value) {
-		return
-	}
-	cbk(iff, index)
-	for i, v := range iff.Then {
-		v.eval(msg, append(append(index[:0:0], index...), i), cbk)
+		if sc.empty() {
+			return cmdResult{ok: true}
+		}
+		return sc.perform(replaces, passViaPipe, log)
 	}
 }
 
@@ -138,20 +257,19 @@ func (sc subCommand) empty() bool {
 	return len(sc) == 0 || strings.TrimSpace(sc[0]) == ""
 }
 
-func (sc subCommand) perform(replaces map[string]string, passViaPipe []byte, log *logrus.Entry) bool {
+func (sc subCommand) perform(replaces map[string]string, passViaPipe []byte, log *logrus.Entry) cmdResult {
 	if sc.empty() {
-		return true
+		return cmdResult{ok: true}
 	}
 
+	acquireExecSlot()
+	defer releaseExecSlot()
+
 	// command and args
 	cmd := strings.TrimSpace(sc[0])
 	cmdArgs := make([]string, len(sc)-1)
 	if len(cmdArgs) > 0 {
-		arr := make([]string, 2*len(replaces))
-		for k, v := range replaces {
-			arr = append(arr, k, v)
-		}
-		replacer := strings.NewReplacer(arr...)
+		replacer := newCommandReplacer(replaces)
 		for i, v := range sc[1:] {
 			cmdArgs[i] = replacer.Replace(v)
 		}
@@ -165,13 +283,13 @@ func (sc subCommand) perform(replaces map[string]string, passViaPipe []byte, log
 		stdin, err := command.StdinPipe()
 		if err != nil {
 			log.Error("Failed to open pipe: ", err)
-			return false
+			return cmdResult{ok: false, detail: err.Error()}
 		}
 		defer stdin.Close()
 		_, err = stdin.Write([]byte(base64.StdEncoding.EncodeToString(passViaPipe)))
 		if err != nil {
 			log.Error("Failed to write to pipe: ", err)
-			return false
+			return cmdResult{ok: false, detail: err.Error()}
 		}
 	}
 
@@ -180,9 +298,24 @@ func (sc subCommand) perform(replaces map[string]string, passViaPipe []byte, log
 	if err != nil {
 		log.Error("Error: ", err)
 		log.Error("Output: ", string(output))
-	} else {
-		log.Info("Success")
-		log.Debug("Output: ", string(output))
+		exitCode := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+		return cmdResult{ok: false, detail: err.Error() + ": " + stderrTail(output), exitCode: exitCode}
+	}
+	log.Info("Success")
+	log.Debug("Output: ", string(output))
+	return cmdResult{ok: true}
+}
+
+// stderrTail trims command output down to its last few lines, enough to diagnose a
+// failure without flooding logs or dead letter records with a large stdout/stderr dump
+func stderrTail(output []byte) string {
+	const maxTailBytes = 2048
+	s := strings.TrimSpace(string(output))
+	if len(s) > maxTailBytes {
+		s = s[len(s)-maxTailBytes:]
 	}
-	return true
+	return s
 }